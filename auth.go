@@ -0,0 +1,122 @@
+//go:generate easyjson auth.go
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/myfreeweb/go-email/email"
+	zap "go.uber.org/zap"
+)
+
+// dkimSelectorTagRegex extracts the "s=" (selector) tag from a raw
+// DKIM-Signature header value, per RFC 6376 section 3.5. dkim.Verification
+// doesn't expose the selector it verified against, so we recover it
+// ourselves from the header it was produced from.
+var dkimSelectorTagRegex = regexp.MustCompile(`(?:^|;)\s*s\s*=\s*([^;]+)`)
+
+// dkimSelectors returns the "s=" tag of each DKIM-Signature header, in the
+// order they appear, for zipping up against dkim.Verify's results (which are
+// returned in the same order the signatures were found).
+func dkimSelectors(header email.Header) []string {
+	var selectors []string
+	for _, sig := range header["Dkim-Signature"] {
+		selector := ""
+		if m := dkimSelectorTagRegex.FindStringSubmatch(sig); m != nil {
+			selector = strings.TrimSpace(m[1])
+		}
+		selectors = append(selectors, selector)
+	}
+	return selectors
+}
+
+//easyjson:json
+type DKIMResult struct {
+	Domain   string `json:"domain,omitempty"`
+	Selector string `json:"selector,omitempty"`
+	Result   string `json:"result,omitempty"`
+}
+
+//easyjson:json
+type SPFResult struct {
+	Domain string `json:"domain,omitempty"`
+	Result string `json:"result,omitempty"`
+}
+
+//easyjson:json
+type DMARCResult struct {
+	Domain string `json:"domain,omitempty"`
+	Result string `json:"result,omitempty"`
+}
+
+//easyjson:json
+type ARCResult struct {
+	Chain string `json:"chain,omitempty"`
+}
+
+//easyjson:json
+type AuthInfo struct {
+	Dkim  []DKIMResult `json:"dkim,omitempty"`
+	Spf   *SPFResult   `json:"spf,omitempty"`
+	Dmarc *DMARCResult `json:"dmarc,omitempty"`
+	Arc   *ARCResult   `json:"arc,omitempty"`
+}
+
+// verifyAuth runs DKIM signature verification against the raw, undecoded
+// message bytes (DKIM is computed over the original canonicalized message,
+// so it must see the bytes as they were before any charset/CTE decoding;
+// process keeps them aside for this) and parses any
+// Authentication-Results/ARC-Authentication-Results headers added by
+// upstream mail servers, turning them into structured, facetable results
+// instead of opaque header strings. Returns nil if nothing was found.
+func verifyAuth(raw []byte, header email.Header, log *zap.SugaredLogger) *AuthInfo {
+	info := &AuthInfo{}
+	verifications, err := dkim.Verify(bytes.NewReader(raw))
+	if err != nil {
+		log.Warnw("Could not run DKIM verification", "err", err)
+	}
+	selectors := dkimSelectors(header)
+	for i, v := range verifications {
+		selector := ""
+		if i < len(selectors) {
+			selector = selectors[i]
+		}
+		result := "pass"
+		if v.Err != nil {
+			result = "fail"
+			log.Infow("DKIM signature failed verification", "domain", v.Domain, "selector", selector, "err", v.Err)
+		}
+		info.Dkim = append(info.Dkim, DKIMResult{Domain: v.Domain, Selector: selector, Result: result})
+	}
+	for _, name := range []string{"Authentication-Results", "ARC-Authentication-Results"} {
+		for _, val := range header[name] {
+			_, results, err := authres.Parse(val)
+			if err != nil {
+				log.Warnw("Could not parse authentication results header", "header", name, "value", val, "err", err)
+				continue
+			}
+			for _, r := range results {
+				switch res := r.(type) {
+				case *authres.SPFResult:
+					if info.Spf == nil {
+						info.Spf = &SPFResult{Domain: res.From, Result: string(res.Value)}
+					}
+				case *authres.DMARCResult:
+					if info.Dmarc == nil {
+						info.Dmarc = &DMARCResult{Domain: res.From, Result: string(res.Value)}
+					}
+				}
+			}
+			if name == "ARC-Authentication-Results" && info.Arc == nil {
+				info.Arc = &ARCResult{Chain: strings.TrimSpace(val)}
+			}
+		}
+	}
+	if len(info.Dkim) == 0 && info.Spf == nil && info.Dmarc == nil && info.Arc == nil {
+		return nil
+	}
+	return info
+}
@@ -43,6 +43,23 @@ func decodeCharset(charset string, body []byte, description string, ishtml bool,
 	return decoded, charset, nil
 }
 
+// encodeCharset is the inverse of decodeCharset: it re-encodes UTF-8 text
+// into the charset a body was originally declared in, for EML export.
+func encodeCharset(charset string, text string, log *zap.SugaredLogger) ([]byte, error) {
+	if charset == "" {
+		charset = "utf-8"
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil || enc == nil {
+		return nil, err
+	}
+	encoded, err := enc.NewEncoder().Bytes([]byte(text))
+	if err != nil {
+		return nil, err
+	}
+	return encoded, nil
+}
+
 func decodeReader(charset string, input io.Reader, log *zap.SugaredLogger) (io.Reader, error) {
 	body, err := ioutil.ReadAll(input)
 	if err != nil {
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+
+	"github.com/mailru/easyjson"
+	"github.com/myfreeweb/go-base64-simd/base64"
+	zap "go.uber.org/zap"
+)
+
+// addrHeaders lists the headers jsonifyMsg splits into one slice element
+// per address (see splitAddrs in headers.go); they must be rejoined into a
+// single comma-separated header line on export, not written one per line.
+var addrHeaders = map[string]bool{
+	"From":         true,
+	"To":           true,
+	"Cc":           true,
+	"Bcc":          true,
+	"Return-Path":  true,
+	"Delivered-To": true,
+}
+
+// emlifyMsg is the inverse of jsonifyMsg: it serializes a JMessage back into
+// an RFC 5322 message, reattaching blake2b-hashed attachments from attachdir
+// and re-encoding text bodies and multipart boundaries.
+func emlifyMsg(jmsg *JMessage, w io.Writer, log *zap.SugaredLogger) error {
+	log = log.With("msgid", jmsg.Id)
+	bw := bufio.NewWriter(w)
+	ctype := jmsg.Header.Get("Content-Type")
+	mediatype, params, _ := mime.ParseMediaType(ctype)
+	isMultipart := strings.HasPrefix(mediatype, "multipart/") && len(jmsg.Parts) > 0
+	boundary := params["boundary"]
+	if isMultipart {
+		if resolved := resolveBoundary(boundary, log); resolved != boundary {
+			params["boundary"] = resolved
+			jmsg.Header.Set("Content-Type", mime.FormatMediaType(mediatype, params))
+			boundary = resolved
+		}
+	}
+	if err := writeHeader(bw, jmsg); err != nil {
+		return err
+	}
+	if _, err := bw.WriteString("\r\n"); err != nil {
+		return err
+	}
+	if isMultipart {
+		if err := writeMultipartBody(bw, jmsg, boundary, log); err != nil {
+			return err
+		}
+	} else if err := writeBody(bw, jmsg, log); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// resolveBoundary returns boundary unchanged if multipart.Writer will accept
+// it as-is, or a freshly generated boundary otherwise (multipart.SetBoundary
+// rejects boundaries over 70 bytes or containing characters RFC 2046
+// disallows, which some real-world mail clients produce). Callers must write
+// whatever this returns into the Content-Type header actually emitted, or the
+// header and body will disagree about where parts are delimited.
+func resolveBoundary(boundary string, log *zap.SugaredLogger) string {
+	probe := multipart.NewWriter(ioutil.Discard)
+	if boundary != "" {
+		err := probe.SetBoundary(boundary)
+		if err == nil {
+			return boundary
+		}
+		log.Warnw("Could not reuse original boundary, generating a new one", "boundary", boundary, "err", err)
+	}
+	return probe.Boundary()
+}
+
+// writeHeader reconstructs the RFC 5322 header block, re-adding the
+// Message-Id that jsonifyMsg lifted out into JMessage.Id and rejoining
+// address headers that were split into one slice element per address.
+func writeHeader(w io.Writer, jmsg *JMessage) error {
+	for name, vals := range jmsg.Header {
+		if len(vals) == 0 {
+			continue
+		}
+		if addrHeaders[name] {
+			vals = []string{strings.Join(vals, ", ")}
+		}
+		for _, val := range vals {
+			if _, err := fmt.Fprintf(w, "%s: %s\r\n", name, mime.QEncoding.Encode("utf-8", val)); err != nil {
+				return err
+			}
+		}
+	}
+	if jmsg.Id != "" {
+		if _, err := fmt.Fprintf(w, "Message-Id: %s\r\n", jmsg.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeMultipartBody(w io.Writer, jmsg *JMessage, boundary string, log *zap.SugaredLogger) error {
+	mw := multipart.NewWriter(w)
+	if boundary != "" {
+		if err := mw.SetBoundary(boundary); err != nil {
+			// boundary was already resolved by the caller, so this does not
+			// trigger in practice; if it did, mw would keep its own random
+			// boundary, which differs from the one in the header already
+			// written, and this is only logged.
+			log.Warnw("Resolved boundary was rejected by multipart.Writer", "boundary", boundary, "err", err)
+		}
+	}
+	if len(jmsg.Preamble) > 0 {
+		if _, err := w.Write(jmsg.Preamble); err != nil {
+			return err
+		}
+	}
+	for partidx, part := range jmsg.Parts {
+		plog := log.With("partidx", partidx)
+		ptype := part.Header.Get("Content-Type")
+		pmediatype, pparams, _ := mime.ParseMediaType(ptype)
+		partIsMultipart := strings.HasPrefix(pmediatype, "multipart/") && len(part.Parts) > 0
+		pboundary := pparams["boundary"]
+		if partIsMultipart {
+			// Resolve (and, if necessary, rewrite) the nested boundary before
+			// CreatePart writes this part's Content-Type header, since that
+			// header can't be corrected afterwards.
+			if resolved := resolveBoundary(pboundary, plog); resolved != pboundary {
+				pparams["boundary"] = resolved
+				part.Header.Set("Content-Type", mime.FormatMediaType(pmediatype, pparams))
+				pboundary = resolved
+			}
+		}
+		pw, err := mw.CreatePart(textproto.MIMEHeader(part.Header))
+		if err != nil {
+			return err
+		}
+		if partIsMultipart {
+			if err := writeMultipartBody(pw, part, pboundary, plog); err != nil {
+				return err
+			}
+		} else if err := writeBody(pw, part, plog); err != nil {
+			return err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	if len(jmsg.Epilogue) > 0 {
+		if _, err := w.Write(jmsg.Epilogue); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBody re-encodes a leaf JMessage's stored content (plain text, decoded
+// attachment file, or embedded message) back into the original
+// Content-Transfer-Encoding.
+func writeBody(w io.Writer, jmsg *JMessage, log *zap.SugaredLogger) error {
+	if jmsg.SubMessage != nil {
+		return emlifyMsg(jmsg.SubMessage, w, log)
+	}
+	var raw []byte
+	var err error
+	if jmsg.Attachment != "" {
+		raw, err = ioutil.ReadFile(jmsg.Attachment)
+		if err != nil {
+			return fmt.Errorf("could not read attachment %s: %v", jmsg.Attachment, err)
+		}
+	} else {
+		ctype := jmsg.Header.Get("Content-Type")
+		mediatype, params, err := mime.ParseMediaType(ctype)
+		if err != nil {
+			mediatype, params = "text/plain", map[string]string{"charset": "utf-8"}
+		}
+		text := jmsg.TextBody
+		if jmsg.HtmlBody != "" {
+			text = jmsg.HtmlBody
+		}
+		raw, err = encodeCharset(params["charset"], text, log)
+		if err != nil {
+			return fmt.Errorf("could not encode charset for %s: %v", mediatype, err)
+		}
+	}
+	return writeEncoded(w, jmsg.Header.Get("Content-Transfer-Encoding"), raw)
+}
+
+func writeEncoded(w io.Writer, cte string, raw []byte) error {
+	switch strings.ToLower(strings.TrimSpace(cte)) {
+	case "quoted-printable":
+		qw := quotedprintable.NewWriter(w)
+		if _, err := qw.Write(raw); err != nil {
+			return err
+		}
+		return qw.Close()
+	case "base64":
+		enc := base64.StdEncoding.EncodeToString(raw)
+		for len(enc) > 76 {
+			if _, err := fmt.Fprintf(w, "%s\r\n", enc[:76]); err != nil {
+				return err
+			}
+			enc = enc[76:]
+		}
+		_, err := fmt.Fprintf(w, "%s\r\n", enc)
+		return err
+	default:
+		_, err := w.Write(raw)
+		return err
+	}
+}
+
+// exportMsg parses the _source of an ElasticSearch document (fetched by the
+// caller), rebuilds it into an EML byte stream, and returns it for writing to
+// a file.
+func exportMsg(source []byte, log *zap.SugaredLogger) ([]byte, error) {
+	var jmsg JMessage
+	if err := easyjson.Unmarshal(source, &jmsg); err != nil {
+		return nil, fmt.Errorf("could not parse indexed document: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := emlifyMsg(&jmsg, &buf, log); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
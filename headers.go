@@ -21,6 +21,13 @@ func splitAddrs(vals []string) []string {
 var whitespaceRegex = regexp.MustCompile(`\s+`)
 var commentRegex = regexp.MustCompile(`\([^\)]*\)`)
 
+// normalizeCTE lowercases and trims a Content-Transfer-Encoding value so
+// that real-world casings like "BASE64" or "Quoted-Printable" are
+// recognized the same as the canonical lowercase form.
+func normalizeCTE(val string) string {
+	return strings.ToLower(strings.TrimSpace(val))
+}
+
 // RFC 2822 allows whitespace and comments, ElasticSearch/joda-time does not
 func stripSpaceAndComments(vals []string) []string {
 	result := make([]string, 0)
@@ -24,3 +24,25 @@ func TestSplitAddrs(t *testing.T) {
 		splitAddrs([]string{ "hello world <test@example.com> ,	 nice@me.me (test),hi@example.com" }),
 	)
 }
+
+func TestNormalizeCTE(t *testing.T) {
+	cases := []struct {
+		in       string
+		expected string
+	}{
+		{"base64", "base64"},
+		{"BASE64", "base64"},
+		{"Base64", "base64"},
+		{"quoted-printable", "quoted-printable"},
+		{"Quoted-Printable", "quoted-printable"},
+		{"QUOTED-PRINTABLE", "quoted-printable"},
+		{"7BIT", "7bit"},
+		{"8bit", "8bit"},
+		{"Binary", "binary"},
+		{"  base64  ", "base64"},
+		{"", ""},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.expected, normalizeCTE(c.in), "input: %q", c.in)
+	}
+}
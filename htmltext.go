@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+var blockTags = map[string]bool{
+	"p": true, "div": true, "br": true, "hr": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"tr": true, "table": true, "blockquote": true, "pre": true,
+}
+
+// htmlToText renders HTML into a plain-text approximation suitable for
+// full-text search and snippet display: paragraphs are separated by blank
+// lines, links are rendered as "text (href)", and list items get a "- "
+// marker.
+func htmlToText(htmlSrc string) string {
+	z := html.NewTokenizer(strings.NewReader(htmlSrc))
+	var out strings.Builder
+	var hrefStack []string
+	skipDepth := 0
+	listDepth := 0
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return strings.TrimSpace(collapseBlankLines(out.String()))
+		case html.TextToken:
+			if skipDepth == 0 {
+				out.WriteString(string(z.Text()))
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			tag := string(name)
+			switch tag {
+			case "script", "style", "head", "title":
+				if tt == html.StartTagToken {
+					skipDepth++
+				}
+			case "li":
+				out.WriteString("\n" + strings.Repeat("  ", listDepth) + "- ")
+			case "ul", "ol":
+				listDepth++
+				out.WriteString("\n")
+			case "a":
+				href := ""
+				if hasAttr {
+					for {
+						key, val, more := z.TagAttr()
+						if string(key) == "href" {
+							href = string(val)
+						}
+						if !more {
+							break
+						}
+					}
+				}
+				// A self-closing <a/> (common in XHTML-style mail templates
+				// and tracking pixels) never gets a matching EndTagToken, so
+				// it must not push onto hrefStack — write its href inline
+				// right away instead of waiting for a pop that won't come.
+				if tt == html.SelfClosingTagToken {
+					if href != "" {
+						out.WriteString(" (" + href + ")")
+					}
+				} else {
+					hrefStack = append(hrefStack, href)
+				}
+			default:
+				if blockTags[tag] {
+					out.WriteString("\n")
+				}
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			tag := string(name)
+			switch tag {
+			case "script", "style", "head", "title":
+				if skipDepth > 0 {
+					skipDepth--
+				}
+			case "ul", "ol":
+				if listDepth > 0 {
+					listDepth--
+				}
+				out.WriteString("\n")
+			case "a":
+				if n := len(hrefStack); n > 0 {
+					href := hrefStack[n-1]
+					hrefStack = hrefStack[:n-1]
+					if href != "" {
+						out.WriteString(" (" + href + ")")
+					}
+				}
+			default:
+				if blockTags[tag] {
+					out.WriteString("\n")
+				}
+			}
+		}
+	}
+}
+
+func collapseBlankLines(text string) string {
+	lines := strings.Split(text, "\n")
+	var kept []string
+	blank := false
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			if !blank && len(kept) > 0 {
+				kept = append(kept, "")
+			}
+			blank = true
+			continue
+		}
+		blank = false
+		kept = append(kept, trimmed)
+	}
+	return strings.Join(kept, "\n")
+}
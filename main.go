@@ -34,9 +34,23 @@ var attachdir = flag.String("attachdir", "files", "path to the attachments direc
 var elasticUrl = flag.String("elastic", "http://127.0.0.1:9200", "URL of the ElasticSearch server")
 var elasticIndex = flag.String("index", "mail", "name of the ElasticSearch index")
 var doInit = flag.Bool("init", false, "whether to initialize the index instead of indexing mail")
+var exportId = flag.String("export", "", "_id of a message to fetch from ElasticSearch and write out as an .eml file, instead of indexing mail")
 var srvAddr = flag.String("srvaddr", "", "address for the pprof/expvar server to listen on")
+var pgpKeyringPath = flag.String("pgp-keyring", "", "path to a PGP keyring for decrypting multipart/encrypted (PGP/MIME) parts before indexing")
+var smimeStorePath = flag.String("smime-pkcs12", "", "path to a PKCS#12 file with the private key/cert for decrypting application/pkcs7-mime (S/MIME) parts before indexing")
+var smimeStorePassword = flag.String("smime-pkcs12-password", "", "password for the -smime-pkcs12 store")
 
 const indexSettings string = `{
+	"settings": {
+		"analysis": {
+			"analyzer": {
+				"htmlstrip": {
+					"tokenizer": "standard",
+					"char_filter": ["html_strip"]
+				}
+			}
+		}
+	},
 	"mappings": {
 		"msg": {
 			"properties": {
@@ -49,7 +63,41 @@ const indexSettings string = `{
 					}
 				},
 				"a": { "type": "keyword" },
-				"t": { "type": "text" }
+				"t": { "type": "text" },
+				"html": {
+					"type": "text",
+					"analyzer": "htmlstrip"
+				},
+				"auth": {
+					"properties": {
+						"dkim": {
+							"properties": {
+								"domain": { "type": "keyword" },
+								"selector": { "type": "keyword" },
+								"result": { "type": "keyword" }
+							}
+						},
+						"spf": {
+							"properties": {
+								"domain": { "type": "keyword" },
+								"result": { "type": "keyword" }
+							}
+						},
+						"dmarc": {
+							"properties": {
+								"domain": { "type": "keyword" },
+								"result": { "type": "keyword" }
+							}
+						},
+						"arc": {
+							"properties": {
+								"chain": { "type": "text", "index": false }
+							}
+						}
+					}
+				},
+				"enc": { "type": "boolean" },
+				"keyids": { "type": "keyword" }
 			}
 		}
 	}
@@ -64,11 +112,18 @@ type JMessage struct {
 	Parts      []*JMessage  `json:"p,omitempty"`
 	SubMessage *JMessage    `json:"sub,omitempty"`
 	TextBody   string       `json:"t,omitempty"`
+	HtmlBody   string       `json:"html,omitempty"`
 	Attachment string       `json:"a,omitempty"`
+	Auth       *AuthInfo    `json:"auth,omitempty"`
+	Encrypted  bool         `json:"enc,omitempty"`
+	KeyIds     []string     `json:"keyids,omitempty"`
 }
 
 func jsonifyMsg(msg email.Message, log *zap.SugaredLogger) JMessage {
 	log = log.With("msgid", msg.Header.Get("Message-Id"))
+	//// Decryption (PGP/MIME, S/MIME) — must happen before word/charset
+	//// decoding below operates on the (now plaintext) headers and body.
+	encrypted, keyIds := decryptMsg(&msg, log)
 	wordDecoder := new(mime.WordDecoder)
 	wordDecoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
 		return decodeReader(charset, input, log)
@@ -82,6 +137,8 @@ func jsonifyMsg(msg email.Message, log *zap.SugaredLogger) JMessage {
 		SubMessage: nil,
 		TextBody:   "",
 		Attachment: "",
+		Encrypted:  encrypted,
+		KeyIds:     keyIds,
 	}
 	//// Headers
 	delete(result.Header, "Message-Id")
@@ -116,14 +173,15 @@ func jsonifyMsg(msg email.Message, log *zap.SugaredLogger) JMessage {
 	//// Body
 	ctype := result.Header.Get("Content-Type")
 	//// Body Transfer-Encoding
-	if result.Header.Get("Content-Transfer-Encoding") == "quoted-printable" {
+	switch normalizeCTE(result.Header.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
 		decBody, err := ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(msg.Body)))
 		if err != nil {
 			log.Warnw("Could not decode quoted-printable, treating like an attachment", "err", err)
 			goto file
 		}
 		msg.Body = decBody
-	} else if result.Header.Get("Content-Transfer-Encoding") == "base64" {
+	case "base64":
 		unspacedBody := normalizeForBase64(msg.Body)
 		decBody := make([]byte, base64.StdEncoding.DecodedLen(len(unspacedBody)))
 		n, err := base64.StdEncoding.Decode(decBody, unspacedBody)
@@ -132,6 +190,8 @@ func jsonifyMsg(msg email.Message, log *zap.SugaredLogger) JMessage {
 			goto file
 		}
 		msg.Body = decBody
+	case "7bit", "8bit", "binary", "":
+		// no-op decodings, msg.Body is already in its final form
 	}
 	//// Body Charset
 	if strings.HasPrefix(ctype, "text") && !strings.Contains(result.Header.Get("Content-Disposition"), "attachment") {
@@ -155,7 +215,12 @@ func jsonifyMsg(msg email.Message, log *zap.SugaredLogger) JMessage {
 			log.Warnw("Could not decode charset, treating like an attachment", "charset", charset, "err", err)
 			goto file
 		}
-		result.TextBody = string(decoded)
+		if strings.Contains(mediatype, "html") {
+			result.HtmlBody = string(decoded)
+			result.TextBody = htmlToText(result.HtmlBody)
+		} else {
+			result.TextBody = string(decoded)
+		}
 		return result
 	}
 file:
@@ -188,11 +253,16 @@ file:
 }
 
 func process(msgtext io.Reader, log *zap.SugaredLogger) (*JMessage, error) {
-	msg, err := email.ParseMessage(msgtext)
+	raw, err := ioutil.ReadAll(msgtext)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := email.ParseMessage(bytes.NewReader(raw))
 	if err != nil {
 		return nil, err
 	}
 	jmsg := jsonifyMsg(*msg, log)
+	jmsg.Auth = verifyAuth(raw, msg.Header, log)
 	return &jmsg, nil
 }
 
@@ -206,6 +276,12 @@ func main() {
 			log.Infow("pprof/expvar server started", "result", http.ListenAndServe(*srvAddr, nil))
 		}()
 	}
+	if *pgpKeyringPath != "" {
+		loadPGPKeyring(*pgpKeyringPath, log)
+	}
+	if *smimeStorePath != "" {
+		loadSMIMEStore(*smimeStorePath, *smimeStorePassword, log)
+	}
 	ctx := context.Background()
 	client, err := elastic.NewClient(
 		elastic.SetURL(*elasticUrl),
@@ -220,6 +296,25 @@ func main() {
 		} else {
 			log.Infow("Created index", "result", res)
 		}
+	} else if *exportId != "" {
+		res, err := client.Get().Index(*elasticIndex).Type("msg").Id(*exportId).Do(ctx)
+		if err != nil {
+			log.Fatalw("Could not fetch message", "err", err, "id", *exportId)
+		}
+		eml, err := exportMsg(*res.Source, log.With("id", *exportId))
+		if err != nil {
+			log.Fatalw("Could not export message", "err", err, "id", *exportId)
+		}
+		filename := strings.Map(func(r rune) rune {
+			if r == '/' || r == os.PathSeparator {
+				return '_'
+			}
+			return r
+		}, *exportId) + ".eml"
+		if err := ioutil.WriteFile(filename, eml, 0644); err != nil {
+			log.Fatalw("Could not write EML file", "err", err, "filename", filename)
+		}
+		log.Infow("Exported message", "filename", filename)
 	} else if len(flag.Args()) == 0 || flag.Arg(0) == "-" {
 		jmsg, err := process(bufio.NewReader(os.Stdin), log.With("filename", "stdin"))
 		if err != nil {
@@ -240,21 +335,16 @@ func main() {
 		}
 		defer proc.Close()
 		var wg sync.WaitGroup
-		tasks := make(chan string)
+		tasks := make(chan ingestTask)
 		for i := 0; i < runtime.GOMAXPROCS(0); i++ {
 			go func() {
-				for {
+				for t := range tasks {
 					var j []byte
 					var jmsg *JMessage
-					filename := <-tasks
-					log := log.With("filename", filename)
+					var err error
+					log := log.With("filename", t.name)
 					log.Debug("Processing start")
-					file, err := os.Open(filename)
-					if err != nil {
-						log.Errorw("Could not open file", "err", err)
-						goto done
-					}
-					jmsg, err = process(bufio.NewReader(file), log)
+					jmsg, err = process(t.reader, log)
 					if err != nil {
 						log.Errorw("Could not process", "err", err)
 						goto done
@@ -272,33 +362,21 @@ func main() {
 			}()
 		}
 		for _, filename := range flag.Args() {
-			f, err := os.Stat(filename)
+			src, err := sourceFor(filename)
 			if err != nil {
-				log.Fatalw("Could not stat file", "err", err, "filename", filename)
+				log.Fatalw("Could not open source", "err", err, "filename", filename)
 			}
-			if f.Mode().IsDir() {
-				err = filepath.Walk(filename, func(path string, _ os.FileInfo, err error) error {
-					if err != nil {
-						return err
-					}
-					f, err := os.Stat(path)
-					if err != nil {
-						log.Fatalw("Could not stat file", "err", err, "filename", path)
-					}
-					if f.Mode().IsRegular() {
-						wg.Add(1)
-						tasks <- path
-					} else {
-						log.Infow("Not a file", "filename", path)
-					}
-					return nil
-				})
+			for {
+				reader, name, err := src.Next()
+				if err == errSourceDone {
+					break
+				}
 				if err != nil {
-					log.Fatalw("Could not walk directory", "err", err, "filename", filename)
+					log.Errorw("Could not read next message from source", "err", err, "filename", filename)
+					break
 				}
-			} else {
 				wg.Add(1)
-				tasks <- filename
+				tasks <- ingestTask{reader: reader, name: name}
 			}
 		}
 		wg.Wait()
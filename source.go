@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Source yields successive raw messages along with a name to use for logging.
+type Source interface {
+	Next() (io.Reader, string, error)
+}
+
+// ingestTask is a unit of work handed to an ingestion worker: a raw message
+// reader and the name (filename, or filename#N for mbox) to log it as.
+type ingestTask struct {
+	reader io.Reader
+	name   string
+}
+
+var errSourceDone = fmt.Errorf("source exhausted")
+
+// fileSource wraps a single plain RFC 822 file as a one-shot Source.
+type fileSource struct {
+	path string
+	done bool
+}
+
+func newFileSource(path string) *fileSource {
+	return &fileSource{path: path}
+}
+
+func (s *fileSource) Next() (io.Reader, string, error) {
+	if s.done {
+		return nil, "", errSourceDone
+	}
+	s.done = true
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, s.path, err
+	}
+	return bufio.NewReader(file), s.path, nil
+}
+
+var mboxFromLineRegex = regexp.MustCompile(`^From [^\r\n]*\r?\n`)
+var mboxContentLengthRegex = regexp.MustCompile(`(?mi)^Content-Length:\s*(\d+)\r?\n`)
+
+// mboxSource splits an mbox file into individual messages, honoring
+// `>From `-escaping and Content-Length hints per RFC 4155 / "mbox" lore.
+type mboxSource struct {
+	path string
+	sc   *bufio.Scanner
+	f    *os.File
+	idx  int
+	done bool
+}
+
+func newMboxSource(path string) (*mboxSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	sc.Split(splitMboxMessages)
+	return &mboxSource{path: path, sc: sc, f: f}, nil
+}
+
+func (s *mboxSource) Next() (io.Reader, string, error) {
+	if s.done {
+		return nil, "", errSourceDone
+	}
+	if !s.sc.Scan() {
+		s.done = true
+		s.f.Close()
+		if err := s.sc.Err(); err != nil {
+			return nil, s.path, err
+		}
+		return nil, "", errSourceDone
+	}
+	s.idx++
+	name := fmt.Sprintf("%s#%d", s.path, s.idx)
+	body := mboxFromLineRegex.ReplaceAll(s.sc.Bytes(), nil)
+	body = unescapeMboxFromLines(body)
+	return bytes.NewReader(body), name, nil
+}
+
+func unescapeMboxFromLines(body []byte) []byte {
+	return bytes.Replace(body, []byte("\n>From "), []byte("\nFrom "), -1)
+}
+
+// splitMboxMessages is a bufio.SplitFunc that breaks an mbox stream into
+// chunks starting at each unescaped "From " line, respecting a
+// Content-Length header when present so embedded "From " lines in a body
+// don't split a message early.
+func splitMboxMessages(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if len(data) == 0 {
+		if atEOF {
+			return 0, nil, nil
+		}
+		return 0, nil, nil
+	}
+	// skip is how far we had to resync into data to find an unescaped
+	// "From " line; every advance we return below must be relative to the
+	// original data argument, not this resynced view, or bufio.Scanner will
+	// silently replay/drop bytes on the next call.
+	skip := 0
+	if !bytes.HasPrefix(data, []byte("From ")) {
+		if idx := nextFromLine(data); idx >= 0 {
+			skip = idx
+		} else if !atEOF {
+			return 0, nil, nil
+		} else {
+			return len(data), nil, nil
+		}
+	}
+	msg := data[skip:]
+	headerEnd := bytes.Index(msg, []byte("\r\n\r\n"))
+	sep := "\r\n\r\n"
+	if headerEnd < 0 {
+		headerEnd = bytes.Index(msg, []byte("\n\n"))
+		sep = "\n\n"
+	}
+	if headerEnd >= 0 {
+		// Include the separator so a Content-Length on the last header line
+		// still has the trailing newline the regex requires.
+		if m := mboxContentLengthRegex.FindSubmatch(msg[:headerEnd+len(sep)]); m != nil {
+			n, convErr := strconv.Atoi(string(m[1]))
+			if convErr == nil {
+				bodyStart := headerEnd + len(sep)
+				end := bodyStart + n
+				if end <= len(msg) {
+					return skip + end, msg[:end], nil
+				} else if !atEOF {
+					return 0, nil, nil
+				}
+			}
+		}
+	}
+	searchFrom := headerEnd
+	if searchFrom < 0 {
+		searchFrom = 0
+	}
+	if idx := nextFromLine(msg[searchFrom:]); idx >= 0 {
+		end := searchFrom + idx
+		return skip + end, msg[:end], nil
+	}
+	if atEOF {
+		return skip + len(msg), msg, nil
+	}
+	return 0, nil, nil
+}
+
+// nextFromLine finds the offset of the next unescaped "\nFrom " line.
+func nextFromLine(data []byte) int {
+	off := 0
+	for {
+		idx := bytes.Index(data[off:], []byte("\nFrom "))
+		if idx < 0 {
+			return -1
+		}
+		return off + idx + 1
+	}
+}
+
+// maildirSource walks a Maildir tree (cur/ and new/) yielding each message
+// file in turn.
+type maildirSource struct {
+	files []string
+	idx   int
+}
+
+func newMaildirSource(root string) (*maildirSource, error) {
+	var files []string
+	for _, sub := range []string{"cur", "new"} {
+		dir := filepath.Join(root, sub)
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+	return &maildirSource{files: files}, nil
+}
+
+func (s *maildirSource) Next() (io.Reader, string, error) {
+	if s.idx >= len(s.files) {
+		return nil, "", errSourceDone
+	}
+	path := s.files[s.idx]
+	s.idx++
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, path, err
+	}
+	return bufio.NewReader(file), path, nil
+}
+
+// walkSource recursively walks a directory yielding every regular file as a
+// raw RFC 822 message, preserving the pre-existing filepath.Walk behavior.
+type walkSource struct {
+	files []string
+	idx   int
+}
+
+func newWalkSource(root string) (*walkSource, error) {
+	var files []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &walkSource{files: files}, nil
+}
+
+func (s *walkSource) Next() (io.Reader, string, error) {
+	if s.idx >= len(s.files) {
+		return nil, "", errSourceDone
+	}
+	path := s.files[s.idx]
+	s.idx++
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, path, err
+	}
+	return bufio.NewReader(file), path, nil
+}
+
+// isMaildir reports whether path looks like the root of a Maildir tree.
+func isMaildir(path string) bool {
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if info, err := os.Stat(filepath.Join(path, sub)); err != nil || !info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// sourceFor picks a Source implementation based on the filename/contents
+// of path: an mbox file (by extension or "From " magic), a Maildir tree,
+// any other directory (every regular file under it is a raw RFC 822
+// message), or a single raw RFC 822 message otherwise.
+func sourceFor(path string) (Source, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		if isMaildir(path) {
+			return newMaildirSource(path)
+		}
+		return newWalkSource(path)
+	}
+	if strings.HasSuffix(path, ".mbox") || looksLikeMbox(path) {
+		return newMboxSource(path)
+	}
+	return newFileSource(path), nil
+}
+
+func looksLikeMbox(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	head := make([]byte, 5)
+	n, _ := file.Read(head)
+	return n == 5 && string(head) == "From "
+}